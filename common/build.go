@@ -2,14 +2,18 @@ package common
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net/url"
-	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/yangzx554/gitlab-ci-multi-runner/common/session"
 )
 
 type BuildState string
@@ -21,14 +25,30 @@ const (
 	Success            = "success"
 )
 
+// DefaultMaxBuildTimeout is used whenever a runner doesn't configure its own
+// per-build timeout.
+const DefaultMaxBuildTimeout = 1 * time.Hour
+
+// CancelGracePeriod is how long Run waits, after forwarding a canceled
+// context into the executor (expected to SIGTERM its sub-process), for
+// Wait to return on its own before escalating to Killer.Kill (SIGKILL).
+const CancelGracePeriod = 10 * time.Second
+
+// CleanupTimeout bounds how long Cleanup gets to tear down a finished
+// build's environment, independent of the build's own context.
+const CleanupTimeout = 30 * time.Second
+
 type Build struct {
 	GetBuildResponse
-	BuildState    BuildState     `json:"build_state"`
-	BuildStarted  time.Time      `json:"build_started"`
-	BuildFinished time.Time      `json:"build_finished"`
-	BuildDuration time.Duration  `json:"build_duration"`
-	BuildMessage  string         `json:"build_message"`
-	BuildAbort    chan os.Signal `json:"-"`
+	BuildState    BuildState    `json:"build_state"`
+	BuildStarted  time.Time     `json:"build_started"`
+	BuildFinished time.Time     `json:"build_finished"`
+	BuildDuration time.Duration `json:"build_duration"`
+	BuildMessage  string        `json:"build_message"`
+	// Stages records per-phase timing (prepare/start/run/cleanup) so
+	// operators can see where a job's wall-clock time went.
+	Stages []BuildStage `json:"stages,omitempty"`
+
 	BuildDir      string
 	Hostname      string
 	Runner        *RunnerConfig `json:"runner"`
@@ -44,8 +64,87 @@ type Build struct {
 
 	buildLog     bytes.Buffer `json:"-"`
 	buildLogLock sync.RWMutex
+
+	// traceSentOffset is the number of leading bytes of buildLog already
+	// accepted by the coordinator; sendTracePatch only ships [traceSentOffset:].
+	traceSentOffset int
+
+	// traceLimitReached is set once buildLog hits TraceBytesLimit, after
+	// which further writes are dropped instead of growing the buffer further.
+	traceLimitReached bool
+
+	// masker, when set via SetMaskedValues, replaces secret values with
+	// [MASKED] before they ever reach buildLog.
+	masker *secretMasker
+
+	ctx        context.Context
+	cancel     context.CancelFunc
+	cancelOnce sync.Once
+
+	// Session, when non-nil, lets an authenticated user attach an
+	// interactive terminal or a proxied port to this build while it runs.
+	Session *session.Session `json:"-"`
+
+	// SessionURL is the URL (with the session's token embedded) that the
+	// coordinator relays to the user so they can attach to Session. It's
+	// reported alongside the trace in UpdateBuild.
+	SessionURL string `json:"session_url,omitempty"`
+
+	sessionID string
+}
+
+// SessionServer is the process-wide session.Server that each build's
+// Session is registered with. It stays nil (disabling interactive session
+// support entirely) until the runner daemon configures one.
+var SessionServer *session.Server
+
+// TerminalExecutor is implemented by executors that can attach an
+// interactive terminal to a running build.
+type TerminalExecutor interface {
+	Terminal(conn io.ReadWriteCloser) error
 }
 
+// ProxyExecutor is implemented by executors that can proxy a port from
+// inside the build's environment.
+type ProxyExecutor interface {
+	Proxy(port int, conn io.ReadWriteCloser) error
+}
+
+// Killer is implemented by executors whose sub-process needs an explicit
+// hard-kill escalation (SIGKILL) when it doesn't react to a canceled
+// context within CancelGracePeriod.
+type Killer interface {
+	Kill() error
+}
+
+func terminalHandlerFor(executor Executor) session.TerminalHandler {
+	term, ok := executor.(TerminalExecutor)
+	if !ok {
+		return nil
+	}
+	return term.Terminal
+}
+
+func proxyHandlerFor(executor Executor) session.ProxyHandler {
+	proxy, ok := executor.(ProxyExecutor)
+	if !ok {
+		return nil
+	}
+	return proxy.Proxy
+}
+
+// TraceBytesLimit bounds how much of a job's log is kept and forwarded to
+// the coordinator; beyond it, WriteString/WriteRune stop appending. This
+// keeps a runaway job (or an infinite loop writing to stdout) from growing
+// buildLog without bound.
+const TraceBytesLimit = 4 * 1024 * 1024
+
+// TraceUpdateInterval is how often the background trace worker patches
+// newly accumulated log bytes to the coordinator.
+const TraceUpdateInterval = 3 * time.Second
+
+const traceLimitMessage = "\nJob's log exceeded limit of %d bytes.\n"
+
 func (b *Build) AssignID(otherBuilds ...*Build) {
 	globals := make(map[int]bool)
 	runners := make(map[int]bool)
@@ -93,8 +192,119 @@ func (b *Build) ProjectUniqueName() string {
 }
 
 func (b *Build) ProjectUniqueDir() string {
-	return fmt.Sprintf("%s-%d-%d",
+	dir := fmt.Sprintf("%s-%d-%d",
 		b.Runner.ShortDescription(), b.ProjectID, b.ProjectRunnerID)
+
+	if b.GetGitStrategy() == GitClone {
+		// clone always starts from an empty directory anyway, so there's no
+		// benefit in reusing the project's stable slot across builds, and
+		// giving each build its own avoids two concurrent clones colliding.
+		dir = fmt.Sprintf("%s-build-%d", dir, b.GlobalID)
+	}
+
+	return dir
+}
+
+// GitStrategy selects how a build's working copy is prepared before the job
+// script runs.
+type GitStrategy int
+
+const (
+	GitClone GitStrategy = iota
+	GitFetch
+	GitNone
+)
+
+// SubmoduleStrategy selects how (if at all) git submodules are updated
+// alongside the main checkout.
+type SubmoduleStrategy int
+
+const (
+	SubmoduleNone SubmoduleStrategy = iota
+	SubmoduleNormal
+	SubmoduleRecursive
+)
+
+const defaultGitCleanFlags = "-ffdx"
+
+// builtinGitStrategy is the fallback used when neither the job nor the
+// runner configured a GitStrategy.
+const builtinGitStrategy = GitFetch
+
+// builtinSubmoduleStrategy is the fallback used when neither the job nor
+// the runner configured a SubmoduleStrategy.
+const builtinSubmoduleStrategy = SubmoduleNone
+
+// parseGitStrategy maps a GIT_STRATEGY value to a GitStrategy, returning
+// fallback for an empty or unrecognized value.
+func parseGitStrategy(value string, fallback GitStrategy) GitStrategy {
+	switch value {
+	case "clone":
+		return GitClone
+	case "fetch":
+		return GitFetch
+	case "none":
+		return GitNone
+	default:
+		return fallback
+	}
+}
+
+// parseSubmoduleStrategy maps a GIT_SUBMODULE_STRATEGY value to a
+// SubmoduleStrategy, returning fallback for an empty or unrecognized value.
+func parseSubmoduleStrategy(value string, fallback SubmoduleStrategy) SubmoduleStrategy {
+	switch value {
+	case "normal":
+		return SubmoduleNormal
+	case "recursive":
+		return SubmoduleRecursive
+	case "none":
+		return SubmoduleNone
+	default:
+		return fallback
+	}
+}
+
+// GetGitStrategy returns the GIT_STRATEGY the job was submitted with,
+// falling back to the runner's own configured default
+// (RunnerConfig.GitStrategy) and, failing that, to builtinGitStrategy.
+func (b *Build) GetGitStrategy() GitStrategy {
+	runnerDefault := builtinGitStrategy
+	if b.Runner != nil {
+		runnerDefault = parseGitStrategy(b.Runner.GitStrategy, builtinGitStrategy)
+	}
+	return parseGitStrategy(b.Variables.Get("GIT_STRATEGY"), runnerDefault)
+}
+
+// GetSubmoduleStrategy returns the GIT_SUBMODULE_STRATEGY the job was
+// submitted with, falling back to the runner's own configured default
+// (RunnerConfig.SubmoduleStrategy) and, failing that, to
+// builtinSubmoduleStrategy.
+func (b *Build) GetSubmoduleStrategy() SubmoduleStrategy {
+	runnerDefault := builtinSubmoduleStrategy
+	if b.Runner != nil {
+		runnerDefault = parseSubmoduleStrategy(b.Runner.SubmoduleStrategy, builtinSubmoduleStrategy)
+	}
+	return parseSubmoduleStrategy(b.Variables.Get("GIT_SUBMODULE_STRATEGY"), runnerDefault)
+}
+
+// GetGitCleanFlags returns the flags to pass to `git clean`, honoring
+// GIT_CLEAN_FLAGS if the job set it.
+func (b *Build) GetGitCleanFlags() string {
+	if flags := b.Variables.Get("GIT_CLEAN_FLAGS"); flags != "" {
+		return flags
+	}
+	return defaultGitCleanFlags
+}
+
+// GetGitDepth returns the GIT_DEPTH the job requested, or 0 if unset or
+// invalid, meaning "no depth limit".
+func (b *Build) GetGitDepth() int {
+	depth, err := strconv.Atoi(b.Variables.Get("GIT_DEPTH"))
+	if err != nil || depth <= 0 {
+		return 0
+	}
+	return depth
 }
 
 func (b *Build) ProjectSlug() (string, error) {
@@ -119,14 +329,47 @@ func (b *Build) ProjectSlug() (string, error) {
 	return slug, nil
 }
 
+// FullProjectDir returns the absolute path of the build's working copy.
+// BuildDir is derived from ProjectUniqueDir, so it already reflects the
+// stable-vs-ephemeral distinction between the fetch and clone strategies.
 func (b *Build) FullProjectDir() string {
 	return b.BuildDir
 }
 
-func (b *Build) StartBuild(buildDir string) {
+// StartBuild derives a cancelable, timeout-bound context from ctx and
+// registers the build so it can later be located and canceled by its
+// RunnerID/GlobalID pair through CancelBuild. maxBuildTimeout <= 0 falls back to
+// DefaultMaxBuildTimeout.
+func (b *Build) StartBuild(ctx context.Context, buildDir string, maxBuildTimeout time.Duration) {
 	b.BuildStarted = time.Now()
 	b.BuildState = Pending
 	b.BuildDir = buildDir
+
+	if maxBuildTimeout <= 0 {
+		maxBuildTimeout = DefaultMaxBuildTimeout
+	}
+	b.ctx, b.cancel = context.WithTimeout(ctx, maxBuildTimeout)
+
+	registerBuild(b)
+
+	if SessionServer != nil {
+		if sess, err := SessionServer.NewSessionFor(); err == nil {
+			b.Session = sess
+			b.sessionID = fmt.Sprintf("%d-%d", b.RunnerID, b.GlobalID)
+			b.SessionURL = SessionServer.Register(b.sessionID, sess)
+		}
+	}
+}
+
+// Cancel aborts the running build. It is safe to call multiple times, and
+// from a goroutine other than the one running Run, without racing the
+// log-sending goroutine: it only ever touches the context, never buildLog.
+func (b *Build) Cancel() {
+	b.cancelOnce.Do(func() {
+		if b.cancel != nil {
+			b.cancel()
+		}
+	})
 }
 
 func (b *Build) FinishBuild(buildState BuildState, buildMessage string, args ...interface{}) {
@@ -134,6 +377,30 @@ func (b *Build) FinishBuild(buildState BuildState, buildMessage string, args ...
 	b.BuildMessage = "\n" + fmt.Sprintf(buildMessage, args...)
 	b.BuildFinished = time.Now()
 	b.BuildDuration = b.BuildFinished.Sub(b.BuildStarted)
+
+	b.buildLogLock.Lock()
+	b.flushMasker()
+	b.buildLogLock.Unlock()
+
+	// Send the terminal state — BuildState, the full trace, Stages, and
+	// SessionURL — as one atomic UpdateBuild, so the coordinator never
+	// observes a "finished" build with a stale trace or missing stage
+	// timings. sendTracePatch's incremental PATCH only ever carries trace
+	// bytes, so it can't be used for this; SendBuildLog is the only path
+	// that transmits everything together.
+	b.SendBuildLog()
+	unregisterBuild(b)
+
+	if b.Session != nil && SessionServer != nil {
+		SessionServer.Unregister(b.sessionID)
+		b.Session = nil
+		b.SessionURL = ""
+	}
+
+	// The build is done either way (canceled, timed out, or completed on its
+	// own): release the context created in StartBuild so its timer doesn't
+	// keep firing and startTraceWorker's goroutine stops.
+	b.Cancel()
 }
 
 func (b *Build) BuildLog() string {
@@ -148,53 +415,314 @@ func (b *Build) BuildLogLen() int {
 	return b.buildLog.Len()
 }
 
+// SetMaskedValues configures the values that must never reach the build log
+// in cleartext — CI variables marked `masked: true`, plus runner-level
+// secrets such as b.Runner.Token. It must be called before the build starts
+// writing to its log (i.e. before Run).
+func (b *Build) SetMaskedValues(values []string) {
+	b.buildLogLock.Lock()
+	defer b.buildLogLock.Unlock()
+	b.masker = newSecretMasker(values)
+}
+
 func (b *Build) WriteString(data string) (int, error) {
 	b.buildLogLock.Lock()
 	defer b.buildLogLock.Unlock()
-	return b.buildLog.WriteString(data)
+	return b.appendTrace(len(data), b.mask(data))
 }
 
 func (b *Build) WriteRune(r rune) (int, error) {
 	b.buildLogLock.Lock()
 	defer b.buildLogLock.Unlock()
-	return b.buildLog.WriteRune(r)
+	data := string(r)
+	return b.appendTrace(len(data), b.mask(data))
+}
+
+// mask must be called with buildLogLock held; it passes data through the
+// masker if one is configured, otherwise it's a no-op.
+func (b *Build) mask(data string) string {
+	if b.masker == nil {
+		return data
+	}
+	return string(b.masker.Write([]byte(data)))
+}
+
+// flushMasker must be called with buildLogLock held; it releases anything
+// the masker is still holding back, e.g. on FinishBuild when no more input
+// is coming.
+func (b *Build) flushMasker() {
+	if b.masker == nil {
+		return
+	}
+	if tail := b.masker.Flush(); len(tail) > 0 {
+		b.appendTrace(0, string(tail))
+	}
+}
+
+// appendTrace must be called with buildLogLock held. data is what actually
+// gets appended to buildLog (already masked), while originalLen is what's
+// reported back as the number of bytes consumed, so WriteString/WriteRune
+// keep the usual io.Writer contract of n == len(p) on success. Past
+// TraceBytesLimit it stops growing buildLog, emitting the limit marker
+// exactly once.
+func (b *Build) appendTrace(originalLen int, data string) (int, error) {
+	if b.traceLimitReached {
+		return originalLen, nil
+	}
+
+	if b.buildLog.Len()+len(data) > TraceBytesLimit {
+		if remaining := TraceBytesLimit - b.buildLog.Len(); remaining > 0 {
+			b.buildLog.WriteString(data[:remaining])
+		}
+		b.buildLog.WriteString(fmt.Sprintf(traceLimitMessage, TraceBytesLimit))
+		b.traceLimitReached = true
+		return originalLen, nil
+	}
+
+	b.buildLog.WriteString(data)
+	return originalLen, nil
 }
 
 func (b *Build) SendBuildLog() {
 	var buildTrace string
 
 	buildTrace = b.BuildLog()
+	sentLen := len(buildTrace)
 	if b.BuildMessage != "" {
 		buildTrace = buildTrace + b.BuildMessage
 	}
 
+	b.buildLogLock.RLock()
+	stages := append([]BuildStage(nil), b.Stages...)
+	b.buildLogLock.RUnlock()
+
 	for {
-		if UpdateBuild(*b.Runner, b.ID, b.BuildState, buildTrace) != UpdateFailed {
+		if UpdateBuild(*b.Runner, b.ID, b.BuildState, buildTrace, stages, b.SessionURL) != UpdateFailed {
 			break
 		} else {
 			time.Sleep(UpdateRetryInterval * time.Second)
 		}
 	}
+
+	b.buildLogLock.Lock()
+	b.traceSentOffset = sentLen
+	b.buildLogLock.Unlock()
+}
+
+// startTraceWorker runs until ctx is done, periodically shipping newly
+// accumulated trace bytes to the coordinator via PatchTrace. It is the
+// incremental counterpart to SendBuildLog's full resend.
+func (b *Build) startTraceWorker(ctx context.Context) {
+	ticker := time.NewTicker(TraceUpdateInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			b.sendTracePatch()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// sendTracePatch ships only the bytes accumulated since the last
+// successfully acknowledged offset; PatchTrace carries trace bytes alone, so
+// it never reports Stages or SessionURL. If the coordinator rejects the
+// patch (range mismatch, or it doesn't support patching at all) it falls
+// back to a full resend via SendBuildLog instead of failing the job. This is
+// fine for intermediate ticks: FinishBuild always issues its own terminal
+// SendBuildLog, which is the one call guaranteed to deliver Stages and
+// SessionURL regardless of how many of sendTracePatch's ticks a patch-capable
+// server accepted.
+func (b *Build) sendTracePatch() {
+	b.buildLogLock.RLock()
+	offset := b.traceSentOffset
+	data := append([]byte(nil), b.buildLog.Bytes()[offset:]...)
+	b.buildLogLock.RUnlock()
+
+	if len(data) == 0 {
+		return
+	}
+
+	switch PatchTrace(*b.Runner, b.ID, data, offset) {
+	case PatchSucceeded:
+		b.buildLogLock.Lock()
+		b.traceSentOffset = offset + len(data)
+		b.buildLogLock.Unlock()
+	case PatchNotSupported, PatchRangeMismatch:
+		b.SendBuildLog()
+	case PatchFailed:
+		// Leave traceSentOffset untouched; the next tick retries the same range.
+	}
 }
 
 func (b *Build) Run() error {
 	executor := GetExecutor(b.Runner.Executor)
 	if executor == nil {
 		b.FinishBuild(Failed, "Executor not found: %v", b.Runner.Executor)
-		b.SendBuildLog()
 		return errors.New("executor not found")
 	}
 
-	err := executor.Prepare(b.Runner, b)
+	ctx := b.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	go b.startTraceWorker(ctx)
+
+	prepareSpan := b.Span("Preparing environment")
+	err := executor.Prepare(ctx, b.Runner, b)
+	prepareSpan.End(err)
+
+	if err == nil && b.Session != nil {
+		b.Session.SetHandlers(terminalHandlerFor(executor), proxyHandlerFor(executor))
+	}
+
 	if err == nil {
-		err = executor.Start()
+		startSpan := b.Span("Starting build")
+		err = executor.Start(ctx)
+		startSpan.End(err)
 	}
 	if err == nil {
-		err = executor.Wait()
+		waitSpan := b.Span("Running build")
+		err = b.waitForBuild(ctx, executor)
+		waitSpan.End(err)
 	}
 	executor.Finish(err)
-	if executor != nil {
-		executor.Cleanup()
-	}
+
+	// Cleanup gets its own context rather than the (possibly already
+	// expired or canceled) build ctx: it still has to run a canceled job's
+	// teardown, and waitForBuild has already guaranteed Wait returned
+	// before we get here, so it's safe to start.
+	cleanupCtx, cancelCleanup := context.WithTimeout(context.Background(), CleanupTimeout)
+	defer cancelCleanup()
+
+	cleanupSpan := b.Span("Cleaning up")
+	executor.Cleanup(cleanupCtx)
+	cleanupSpan.End(nil)
+
 	return err
 }
+
+// BuildStage records the outcome of one Span: how long an executor phase
+// took and whether it succeeded.
+type BuildStage struct {
+	Name     string        `json:"name"`
+	Duration time.Duration `json:"duration"`
+	Success  bool          `json:"success"`
+}
+
+// Span tracks one executor phase started by Build.Span. Call End once the
+// phase completes.
+type Span struct {
+	build   *Build
+	name    string
+	started time.Time
+}
+
+// Span starts timing a named executor phase and writes an in-progress
+// marker to the build log.
+func (b *Build) Span(name string) *Span {
+	b.WriteString(fmt.Sprintf("%s...\n", name))
+	return &Span{build: b, name: name, started: time.Now()}
+}
+
+// End records the phase's duration and outcome onto Build.Stages, and
+// writes a one-line summary to the build log.
+func (s *Span) End(err error) {
+	duration := time.Since(s.started)
+
+	s.build.buildLogLock.Lock()
+	s.build.Stages = append(s.build.Stages, BuildStage{
+		Name:     s.name,
+		Duration: duration,
+		Success:  err == nil,
+	})
+	s.build.buildLogLock.Unlock()
+
+	status := "done"
+	if err != nil {
+		status = fmt.Sprintf("failed: %v", err)
+	}
+	s.build.WriteString(fmt.Sprintf("%s %s in %s\n", s.name, status, duration.Round(time.Millisecond)))
+}
+
+// waitForBuild blocks until the executor's Wait actually returns — even
+// past a cancellation — so Run never calls Cleanup while Wait is still
+// running against the same executor, and so the goroutine running Wait is
+// never left running unobserved.
+//
+// ctx being canceled forwards into executor.Wait (expected to react by
+// sending SIGTERM to its sub-process). waitForBuild then gives it
+// CancelGracePeriod to return on its own before escalating to Killer.Kill
+// (SIGKILL) if the executor supports it, but it always blocks on waitCh
+// afterwards regardless of how long that takes.
+func (b *Build) waitForBuild(ctx context.Context, executor Executor) error {
+	waitCh := make(chan error, 1)
+	go func() {
+		waitCh <- executor.Wait(ctx)
+	}()
+
+	select {
+	case err := <-waitCh:
+		return err
+	case <-ctx.Done():
+		select {
+		case err := <-waitCh:
+			return err
+		case <-time.After(CancelGracePeriod):
+			if killer, ok := executor.(Killer); ok {
+				killer.Kill()
+			}
+
+			<-waitCh // Wait must return before Run can safely call Cleanup.
+
+			if ctx.Err() == context.DeadlineExceeded {
+				return errors.New("job timed out")
+			}
+			return errors.New("job canceled")
+		}
+	}
+}
+
+// runningBuilds tracks in-flight builds so CancelBuild can reach a specific
+// build from outside of whatever goroutine is running it (e.g. the runner
+// daemon handling an out-of-band cancellation request), without the caller
+// needing to hold a reference to the *Build itself.
+var (
+	runningBuildsLock sync.Mutex
+	runningBuilds     = map[string]*Build{}
+)
+
+func buildRegistryKey(runnerID int, globalID int) string {
+	return fmt.Sprintf("%d/%d", runnerID, globalID)
+}
+
+func registerBuild(b *Build) {
+	runningBuildsLock.Lock()
+	defer runningBuildsLock.Unlock()
+	runningBuilds[buildRegistryKey(b.RunnerID, b.GlobalID)] = b
+}
+
+func unregisterBuild(b *Build) {
+	runningBuildsLock.Lock()
+	defer runningBuildsLock.Unlock()
+	delete(runningBuilds, buildRegistryKey(b.RunnerID, b.GlobalID))
+}
+
+// CancelBuild cancels the running build identified by runnerID/globalID, if
+// any, and reports whether one was found. It only ever calls Build.Cancel,
+// so it never races the log-sending goroutine which solely reads BuildLog.
+func CancelBuild(runnerID int, globalID int) bool {
+	runningBuildsLock.Lock()
+	b, ok := runningBuilds[buildRegistryKey(runnerID, globalID)]
+	runningBuildsLock.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	b.Cancel()
+	return true
+}
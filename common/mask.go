@@ -0,0 +1,188 @@
+package common
+
+import (
+	"bytes"
+	"regexp"
+)
+
+// maskedPlaceholder replaces every matched secret in the build log.
+const maskedPlaceholder = "[MASKED]"
+
+// ansiEscape matches a terminal escape sequence. Secrets are matched against
+// an ANSI-stripped decoded view of the buffered data so that a sequence
+// emitted mid-secret (e.g. "PASS\x1b[0mWORD") doesn't hide the match, but
+// the original bytes — including any escape sequences outside a matched
+// span — are what's actually emitted, so colored output elsewhere in the
+// log is untouched.
+var ansiEscape = regexp.MustCompile("\x1b\\[[0-9;]*[a-zA-Z]")
+
+// secretMasker is a streaming replacer: secrets can straddle Write
+// boundaries, so it holds back the tail of its input until either more
+// bytes arrive to complete a possible match, or Flush is called.
+type secretMasker struct {
+	secrets []string
+	maxLen  int
+	hold    []byte
+}
+
+// newSecretMasker builds a masker for values (empty strings are ignored,
+// since they'd match everywhere). A masker with no secrets is a no-op.
+func newSecretMasker(values []string) *secretMasker {
+	m := &secretMasker{}
+	for _, v := range values {
+		if v == "" {
+			continue
+		}
+		m.secrets = append(m.secrets, v)
+		if len(v) > m.maxLen {
+			m.maxLen = len(v)
+		}
+	}
+	return m
+}
+
+// Write masks p and returns the prefix that's safe to emit now, holding back
+// up to maxLen-1 trailing bytes (counted with ANSI escapes stripped) in case
+// a secret straddles this call and the next one.
+func (m *secretMasker) Write(p []byte) []byte {
+	if m.maxLen == 0 {
+		return p
+	}
+
+	m.hold = append(m.hold, p...)
+	return m.release(false)
+}
+
+// Flush masks and returns everything still held back; call once on
+// FinishBuild, when no more input is coming.
+func (m *secretMasker) Flush() []byte {
+	if m.maxLen == 0 {
+		out := m.hold
+		m.hold = nil
+		return out
+	}
+	return m.release(true)
+}
+
+// secretMatch is a secret occurrence found in the ANSI-stripped decoded
+// view, in clean-text offsets.
+type secretMatch struct {
+	start, end int
+}
+
+// release finds secret occurrences in an ANSI-stripped decoded view of
+// m.hold, then emits m.hold's original bytes verbatim outside those spans
+// (escape sequences and all) and maskedPlaceholder inside them. It emits
+// everything except a tail holding maxLen-1 bytes of the ANSI-stripped view
+// (see holdbackCut), which might still be an unmatched prefix of a split
+// secret, unless final is true.
+func (m *secretMasker) release(final bool) []byte {
+	original := m.hold
+	clean, origOffset := stripANSI(original)
+	matches := findSecretMatches(clean, m.secrets)
+
+	var out []byte
+	pos := 0
+	for _, match := range matches {
+		start := origOffset(match.start)
+		end := origOffset(match.end-1) + 1
+		out = append(out, original[pos:start]...)
+		out = append(out, maskedPlaceholder...)
+		pos = end
+	}
+	remainder := original[pos:]
+
+	if final {
+		out = append(out, remainder...)
+		m.hold = nil
+		return out
+	}
+
+	cut := m.holdbackCut(remainder)
+	out = append(out, remainder[:cut]...)
+	m.hold = append([]byte(nil), remainder[cut:]...)
+	return out
+}
+
+// holdbackCut returns the original-byte offset in remainder at which to
+// cut: bytes before it are safe to emit now, bytes from it on are held back
+// because they might still be an unmatched prefix of a split secret. The
+// cut is chosen so the held-back suffix contains at least maxLen-1 bytes in
+// the ANSI-stripped ("clean") view, not the original view: an escape
+// sequence embedded in a not-yet-complete secret inflates the original byte
+// count without contributing any bytes a secret could match against, so
+// sizing the holdback off len(remainder) alone under-retains and lets an
+// escape-split secret straddling a Write boundary leak through unmasked.
+func (m *secretMasker) holdbackCut(remainder []byte) int {
+	need := m.maxLen - 1
+	if need <= 0 {
+		return len(remainder)
+	}
+
+	clean, origOffset := stripANSI(remainder)
+	if len(clean) <= need {
+		return 0
+	}
+	return origOffset(len(clean) - need)
+}
+
+// stripANSI strips ANSI escape sequences out of data and returns the
+// stripped ("clean") bytes, plus a function mapping a clean-text offset
+// back to the original offset it corresponds to (escape sequences included
+// up to that point). offset(len(clean)) returns len(data).
+func stripANSI(data []byte) (clean []byte, offset func(int) int) {
+	locs := ansiEscape.FindAllIndex(data, -1)
+
+	clean = make([]byte, 0, len(data))
+	origOffsets := make([]int, 0, len(data))
+
+	last := 0
+	for _, loc := range locs {
+		for i := last; i < loc[0]; i++ {
+			origOffsets = append(origOffsets, i)
+		}
+		clean = append(clean, data[last:loc[0]]...)
+		last = loc[1]
+	}
+	for i := last; i < len(data); i++ {
+		origOffsets = append(origOffsets, i)
+	}
+	clean = append(clean, data[last:]...)
+
+	offset = func(i int) int {
+		if i >= len(origOffsets) {
+			return len(data)
+		}
+		return origOffsets[i]
+	}
+	return clean, offset
+}
+
+// findSecretMatches scans clean left to right for non-overlapping secret
+// occurrences, preferring the longest secret matching at any given
+// position.
+func findSecretMatches(clean []byte, secrets []string) []secretMatch {
+	var matches []secretMatch
+
+	for i := 0; i < len(clean); {
+		matchLen := 0
+		for _, secret := range secrets {
+			if len(secret) <= matchLen || i+len(secret) > len(clean) {
+				continue
+			}
+			if bytes.Equal(clean[i:i+len(secret)], []byte(secret)) {
+				matchLen = len(secret)
+			}
+		}
+
+		if matchLen == 0 {
+			i++
+			continue
+		}
+
+		matches = append(matches, secretMatch{start: i, end: i + matchLen})
+		i += matchLen
+	}
+
+	return matches
+}
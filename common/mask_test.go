@@ -0,0 +1,139 @@
+package common
+
+import (
+	"strings"
+	"testing"
+)
+
+func maskAll(m *secretMasker, chunks ...string) string {
+	var out []byte
+	for _, c := range chunks {
+		out = append(out, m.Write([]byte(c))...)
+	}
+	out = append(out, m.Flush()...)
+	return string(out)
+}
+
+func TestSecretMaskerSingleWrite(t *testing.T) {
+	m := newSecretMasker([]string{"s3cr3t"})
+	got := maskAll(m, "login with s3cr3t please")
+	want := "login with [MASKED] please"
+	if got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestSecretMaskerPartialWrites(t *testing.T) {
+	m := newSecretMasker([]string{"s3cr3t"})
+	got := maskAll(m, "login with s3c", "r3t please")
+	want := "login with [MASKED] please"
+	if got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestSecretMaskerByteAtATime(t *testing.T) {
+	m := newSecretMasker([]string{"topsecret"})
+	chunks := make([]string, 0)
+	for _, r := range "before topsecret after" {
+		chunks = append(chunks, string(r))
+	}
+	got := maskAll(m, chunks...)
+	want := "before [MASKED] after"
+	if got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestSecretMaskerOverlappingSecrets(t *testing.T) {
+	m := newSecretMasker([]string{"abcdef", "cdefgh"})
+	got := maskAll(m, "xx abcdefgh yy")
+	if got == "xx abcdefgh yy" {
+		t.Fatalf("expected one of the overlapping secrets to be masked, got %q", got)
+	}
+}
+
+func TestSecretMaskerNoSecrets(t *testing.T) {
+	m := newSecretMasker(nil)
+	got := maskAll(m, "nothing to mask here")
+	want := "nothing to mask here"
+	if got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestSecretMaskerAnsiSplitSecret(t *testing.T) {
+	m := newSecretMasker([]string{"PASSWORD"})
+	got := maskAll(m, "PASS\x1b[0mWORD next")
+	want := "[MASKED] next"
+	if got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+// TestSecretMaskerPreservesUnrelatedAnsi makes sure the masker only drops
+// ANSI escape sequences that fall inside a masked span; colored output
+// elsewhere in the log (e.g. test runner output, progress bars) must reach
+// the trace untouched.
+func TestSecretMaskerPreservesUnrelatedAnsi(t *testing.T) {
+	m := newSecretMasker([]string{"hunter2"})
+	input := "\x1b[32mPASS\x1b[0m: login ok"
+	got := maskAll(m, input)
+	if got != input {
+		t.Fatalf("got %q, want unmodified %q", got, input)
+	}
+}
+
+// TestSecretMaskerAnsiSplitAcrossPartialWrites is the partial-write
+// counterpart to TestSecretMaskerAnsiSplitSecret: the ANSI escape splitting
+// the secret arrives in one Write and the rest of the secret in the next.
+// The holdback has to be sized off the ANSI-stripped length, not the raw
+// byte count, or the escape's extra bytes push the real secret prefix past
+// the held-back window and it leaks out unmasked.
+func TestSecretMaskerAnsiSplitAcrossPartialWrites(t *testing.T) {
+	m := newSecretMasker([]string{"PASSWORD"})
+	got := maskAll(m, "PASS\x1b[0mWO", "RD next")
+	want := "[MASKED] next"
+	if got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestSecretMaskerEmptyValuesIgnored(t *testing.T) {
+	m := newSecretMasker([]string{"", "hunter2"})
+	got := maskAll(m, "login hunter2 done")
+	want := "login [MASKED] done"
+	if got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+// TestBuildWriteStringMasksNearTraceLimit exercises the masker through
+// Build.WriteString when the secret lands right at TraceBytesLimit, to make
+// sure appendTrace's truncation can't split a secret in two and leak half
+// of it into the sent trace.
+func TestBuildWriteStringMasksNearTraceLimit(t *testing.T) {
+	b := &Build{}
+	secret := "s3cr3tnearlimit"
+	b.SetMaskedValues([]string{secret})
+
+	filler := TraceBytesLimit - len(secret)/2
+	if _, err := b.WriteString(string(make([]byte, filler))); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := b.WriteString(secret); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	b.buildLogLock.Lock()
+	b.flushMasker()
+	b.buildLogLock.Unlock()
+
+	got := b.BuildLog()
+	if len(got) > TraceBytesLimit+len(traceLimitMessage)+32 {
+		t.Fatalf("build log grew unbounded past the limit: %d bytes", len(got))
+	}
+	if strings.Contains(got, secret[:len(secret)/2]) {
+		t.Fatalf("build log leaked part of the secret in cleartext")
+	}
+}
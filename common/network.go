@@ -0,0 +1,109 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// UpdateState describes how the coordinator responded to an UpdateBuild call.
+type UpdateState int
+
+const (
+	UpdateSucceeded UpdateState = iota
+	UpdateAbort
+	UpdateFailed
+)
+
+// UpdateRetryInterval is how long SendBuildLog waits, in seconds, between
+// retries after a failed UpdateBuild.
+const UpdateRetryInterval = 3
+
+type updateBuildRequest struct {
+	State      BuildState   `json:"state"`
+	Trace      string       `json:"trace"`
+	Stages     []BuildStage `json:"stages,omitempty"`
+	SessionURL string       `json:"session_url,omitempty"`
+}
+
+// UpdateBuild reports the build's current state and full trace to the
+// coordinator, along with the per-phase stage timings recorded on
+// Build.Stages and the build's interactive session URL (if any), so
+// operators can see where a job's wall-clock time went and a user can
+// attach to it.
+func UpdateBuild(runner RunnerConfig, id int, state BuildState, trace string, stages []BuildStage, sessionURL string) UpdateState {
+	payload, err := json.Marshal(updateBuildRequest{State: state, Trace: trace, Stages: stages, SessionURL: sessionURL})
+	if err != nil {
+		return UpdateFailed
+	}
+
+	url := fmt.Sprintf("%s/api/v1/builds/%d.json", runner.URL, id)
+	req, err := http.NewRequest("PUT", url, bytes.NewReader(payload))
+	if err != nil {
+		return UpdateFailed
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("PRIVATE-TOKEN", runner.Token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return UpdateFailed
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return UpdateSucceeded
+	case http.StatusForbidden, http.StatusNotFound:
+		return UpdateAbort
+	default:
+		return UpdateFailed
+	}
+}
+
+// PatchTraceResult describes how the coordinator responded to a PatchTrace
+// call.
+type PatchTraceResult int
+
+const (
+	PatchSucceeded PatchTraceResult = iota
+	PatchNotSupported
+	PatchRangeMismatch
+	PatchFailed
+)
+
+// PatchTrace appends data — the trace bytes accumulated since offset — onto
+// the job's existing trace via a single PATCH, instead of resending the
+// whole thing like UpdateBuild does. Servers that don't implement
+// incremental patching, or whose view of the trace has diverged from
+// offset, report PatchNotSupported/PatchRangeMismatch so the caller can
+// fall back to a full UpdateBuild.
+func PatchTrace(runner RunnerConfig, id int, data []byte, offset int) PatchTraceResult {
+	url := fmt.Sprintf("%s/api/v1/builds/%d/trace.txt", runner.URL, id)
+
+	req, err := http.NewRequest("PATCH", url, bytes.NewReader(data))
+	if err != nil {
+		return PatchFailed
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("Content-Range", fmt.Sprintf("%d-%d", offset, offset+len(data)-1))
+	req.Header.Set("PRIVATE-TOKEN", runner.Token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return PatchFailed
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusAccepted:
+		return PatchSucceeded
+	case http.StatusNotFound, http.StatusNotImplemented:
+		return PatchNotSupported
+	case http.StatusRequestedRangeNotSatisfiable:
+		return PatchRangeMismatch
+	default:
+		return PatchFailed
+	}
+}
@@ -0,0 +1,326 @@
+// Package session lets an authenticated user attach an interactive
+// terminal, or a proxy to an in-container service, to a running build.
+package session
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotSupported is returned by executors that don't implement Terminal or
+// Proxy. The session server turns it into a 501 Not Implemented response.
+var ErrNotSupported = errors.New("session: not supported by this executor")
+
+// DefaultSessionTimeout is a Session's default idle timeout: once this long
+// has passed since the session was created or last attached to (terminal or
+// proxy), it's treated as expired and torn down. It's only used when a
+// Server's own SessionTimeout isn't set.
+const DefaultSessionTimeout = 30 * time.Second
+
+// reapInterval is how often a Server sweeps for expired sessions.
+const reapInterval = 10 * time.Second
+
+// TerminalHandler attaches conn to an interactive shell inside the build's
+// environment. It blocks until the terminal session ends.
+type TerminalHandler func(conn io.ReadWriteCloser) error
+
+// ProxyHandler forwards conn to a TCP port inside the build's environment.
+// It blocks until the connection closes.
+type ProxyHandler func(port int, conn io.ReadWriteCloser) error
+
+// Session is one interactive attach point onto a running build. It is
+// created by StartBuild and registered with a Server, which hands back a
+// URL (with the token embedded) that the coordinator relays to the user.
+type Session struct {
+	Token   string
+	Timeout time.Duration
+
+	mu         sync.Mutex
+	lastActive time.Time
+	terminal   TerminalHandler
+	proxy      ProxyHandler
+}
+
+// NewSession creates a Session with a random token. A zero timeout falls
+// back to DefaultSessionTimeout.
+func NewSession(timeout time.Duration) (*Session, error) {
+	token, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+
+	if timeout <= 0 {
+		timeout = DefaultSessionTimeout
+	}
+
+	return &Session{
+		Token:      token,
+		Timeout:    timeout,
+		lastActive: time.Now(),
+	}, nil
+}
+
+func randomToken() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// SetHandlers wires the executor's Terminal/Proxy hooks into the session.
+// Either may be nil, in which case the corresponding endpoint reports
+// ErrNotSupported.
+func (s *Session) SetHandlers(terminal TerminalHandler, proxy ProxyHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.terminal = terminal
+	s.proxy = proxy
+}
+
+// Touch resets the idle timer; called whenever the session handles a
+// request.
+func (s *Session) Touch() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastActive = time.Now()
+}
+
+// Expired reports whether the session has been idle longer than its
+// timeout and should be reaped.
+func (s *Session) Expired() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Since(s.lastActive) > s.Timeout
+}
+
+// SupportsTerminal reports whether the executor registered a terminal
+// handler, so the server can answer with a 501 before hijacking the
+// connection rather than after.
+func (s *Session) SupportsTerminal() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.terminal != nil
+}
+
+// SupportsProxy reports whether the executor registered a proxy handler.
+func (s *Session) SupportsProxy() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.proxy != nil
+}
+
+func (s *Session) attachTerminal(conn io.ReadWriteCloser) error {
+	s.Touch()
+	s.mu.Lock()
+	terminal := s.terminal
+	s.mu.Unlock()
+
+	if terminal == nil {
+		return ErrNotSupported
+	}
+	return terminal(conn)
+}
+
+func (s *Session) attachProxy(port int, conn io.ReadWriteCloser) error {
+	s.Touch()
+	s.mu.Lock()
+	proxy := s.proxy
+	s.mu.Unlock()
+
+	if proxy == nil {
+		return ErrNotSupported
+	}
+	return proxy(port, conn)
+}
+
+// Server is an http.Handler that routes incoming terminal/proxy attach
+// requests, authenticated by a per-session token, to the right Session. It
+// does not open a listener or set up TLS itself.
+type Server struct {
+	// URL is the externally reachable base URL (scheme://host:port) at
+	// which this server accepts connections; used to build session URLs.
+	URL string
+
+	// SessionTimeout is the idle timeout handed to sessions created with
+	// NewSessionFor. Defaults to DefaultSessionTimeout.
+	SessionTimeout time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+// NewServer creates a Server that will advertise baseURL as the address
+// clients should connect to, and starts its background reaper for expired
+// sessions.
+func NewServer(baseURL string) *Server {
+	srv := &Server{
+		URL:            baseURL,
+		SessionTimeout: DefaultSessionTimeout,
+		sessions:       make(map[string]*Session),
+	}
+	go srv.reapExpired()
+	return srv
+}
+
+// NewSessionFor creates a Session honoring the server's own configured
+// SessionTimeout, so callers don't have to hardcode one.
+func (srv *Server) NewSessionFor() (*Session, error) {
+	return NewSession(srv.SessionTimeout)
+}
+
+// Register makes sess reachable under the URL it returns: attach requests
+// go to its /terminal or /proxy/{port} sub-path, with the same token query.
+func (srv *Server) Register(id string, sess *Session) string {
+	srv.mu.Lock()
+	srv.sessions[id] = sess
+	srv.mu.Unlock()
+
+	return fmt.Sprintf("%s/session/%s?token=%s", srv.URL, id, sess.Token)
+}
+
+// Unregister tears the session down; called from FinishBuild.
+func (srv *Server) Unregister(id string) {
+	srv.mu.Lock()
+	delete(srv.sessions, id)
+	srv.mu.Unlock()
+}
+
+func (srv *Server) lookup(id, token string) (*Session, bool) {
+	srv.mu.Lock()
+	sess, ok := srv.sessions[id]
+	srv.mu.Unlock()
+
+	if !ok || sess.Token != token || sess.Expired() {
+		return nil, false
+	}
+	return sess, true
+}
+
+// reapExpired runs for the lifetime of the server, periodically dropping
+// sessions that have not been attached to within their idle timeout (counted
+// from creation or the last attach).
+func (srv *Server) reapExpired() {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		srv.mu.Lock()
+		for id, sess := range srv.sessions {
+			if sess.Expired() {
+				delete(srv.sessions, id)
+			}
+		}
+		srv.mu.Unlock()
+	}
+}
+
+// ServeHTTP implements http.Handler, routing GET /session/{id}/terminal and
+// GET /session/{id}/proxy/{port} (both requiring ?token=...) to the named
+// session. The real transport upgrade (websocket framing for Terminal, raw
+// TCP relaying for Proxy) happens over the hijacked connection by the
+// caller-supplied handler registered via Session.SetHandlers; ServeHTTP's
+// job is only to authenticate and route.
+func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id, token, kind, port, ok := parseSessionPath(r.URL.Path, r.URL.Query().Get("token"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	sess, ok := srv.lookup(id, token)
+	if !ok {
+		http.Error(w, "session not found or expired", http.StatusNotFound)
+		return
+	}
+
+	switch kind {
+	case "terminal":
+		if !sess.SupportsTerminal() {
+			http.Error(w, ErrNotSupported.Error(), http.StatusNotImplemented)
+			return
+		}
+	case "proxy":
+		if !sess.SupportsProxy() {
+			http.Error(w, ErrNotSupported.Error(), http.StatusNotImplemented)
+			return
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection doesn't support hijacking", http.StatusInternalServerError)
+		return
+	}
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if kind == "terminal" {
+		sess.attachTerminal(conn)
+	} else {
+		sess.attachProxy(port, conn)
+	}
+}
+
+// parseSessionPath extracts the session id, attach kind ("terminal" or
+// "proxy"), and optional proxy port from a /session/{id}/{kind}[/{port}]
+// path.
+func parseSessionPath(path, token string) (id, tok, kind string, port int, ok bool) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) < 3 || parts[0] != "session" {
+		return "", "", "", 0, false
+	}
+
+	id, kind = parts[1], parts[2]
+
+	switch kind {
+	case "terminal":
+		return id, token, kind, 0, true
+	case "proxy":
+		if len(parts) < 4 {
+			return "", "", "", 0, false
+		}
+		p, err := strconv.Atoi(parts[3])
+		if err != nil {
+			return "", "", "", 0, false
+		}
+		return id, token, kind, p, true
+	default:
+		return "", "", "", 0, false
+	}
+}
+
+// AttachTerminal looks up the session named by id/token and hands conn to
+// its TerminalHandler. It returns ErrNotSupported (surfaced by the caller
+// as a 501) if the executor never registered one.
+func (srv *Server) AttachTerminal(id, token string, conn io.ReadWriteCloser) error {
+	sess, ok := srv.lookup(id, token)
+	if !ok {
+		return errors.New("session: unknown or expired session")
+	}
+	return sess.attachTerminal(conn)
+}
+
+// AttachProxy looks up the session named by id/token and hands conn to its
+// ProxyHandler for the given port.
+func (srv *Server) AttachProxy(id, token string, port int, conn io.ReadWriteCloser) error {
+	sess, ok := srv.lookup(id, token)
+	if !ok {
+		return errors.New("session: unknown or expired session")
+	}
+	return sess.attachProxy(port, conn)
+}